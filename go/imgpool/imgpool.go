@@ -0,0 +1,91 @@
+// Package imgpool bounds the number of goroutines doing CPU-bound image
+// resize work at once, so a single Lambda container handling several
+// concurrent S3 Object Lambda invocations can't blow its memory budget
+// running Lanczos resampling on large images in parallel.
+package imgpool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQueueFull is returned by Submit when the pool's queue is already at
+// capacity and the caller should back off (e.g. respond 503).
+var ErrQueueFull = errors.New("imgpool: queue is full")
+
+// Job is a unit of CPU-bound work submitted to a Pool.
+type Job func() (any, error)
+
+// Result is what comes back on the channel returned by Submit.
+type Result struct {
+	Value any
+	Err   error
+}
+
+type request struct {
+	job      Job
+	resultCh chan Result
+}
+
+// Pool serializes Job execution across a fixed number of worker goroutines.
+type Pool struct {
+	requests chan request
+	reject   int64 // atomic count of jobs rejected for a full queue
+}
+
+// New starts a Pool with the given number of worker goroutines and a bounded
+// queue of queueDepth pending jobs.
+func New(workers, queueDepth int) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueDepth < 0 {
+		queueDepth = 0
+	}
+
+	p := &Pool{requests: make(chan request, queueDepth)}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *Pool) run() {
+	for req := range p.requests {
+		value, err := req.job()
+		req.resultCh <- Result{Value: value, Err: err}
+	}
+}
+
+// Submit enqueues job for execution and returns a channel that will receive
+// exactly one Result. It does not block waiting for a worker: if the queue
+// is already full, it returns ErrQueueFull immediately so the caller can
+// apply backpressure. The caller is expected to select on both the returned
+// channel and ctx.Done().
+func (p *Pool) Submit(ctx context.Context, job Job) (<-chan Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	resultCh := make(chan Result, 1)
+	select {
+	case p.requests <- request{job: job, resultCh: resultCh}:
+		return resultCh, nil
+	default:
+		atomic.AddInt64(&p.reject, 1)
+		return nil, ErrQueueFull
+	}
+}
+
+// Depth reports the number of jobs currently queued (not yet picked up by a
+// worker).
+func (p *Pool) Depth() int {
+	return len(p.requests)
+}
+
+// RejectCount reports the total number of Submit calls that failed because
+// the queue was full.
+func (p *Pool) RejectCount() int64 {
+	return atomic.LoadInt64(&p.reject)
+}
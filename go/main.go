@@ -15,25 +15,53 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Kagami/go-avif"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/disintegration/imaging"
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+
+	"github.com/katsuokaisao/img-resizer/go/imgpool"
+	"github.com/katsuokaisao/img-resizer/go/phash"
+	"github.com/katsuokaisao/img-resizer/go/resizer"
+	"github.com/katsuokaisao/img-resizer/go/signer"
 )
 
 const (
 	maxBytes              = 10 * 1024 * 1024 // 10MB
 	cacheControlImmutable = "public, max-age=31536000, immutable"
+
+	phashCacheCapacity    = 256
+	defaultPHashThreshold = 4 // max Hamming distance considered a near-duplicate
+
+	defaultQueueDepthPerWorker = 8
+	retryAfterSeconds          = "1"
+
+	defaultAllowedWidths = "240,300,460,700,1040"
 )
 
 var (
 	s3Client   *s3.Client
 	bucketName string
+
+	phashCache     *phash.Cache
+	phashThreshold int
+
+	resizePool    *imgpool.Pool
+	activeResizer resizer.Resizer
+
+	// urlSigner is nil unless URL_SIGNING_KEY is set, in which case every
+	// request must carry a matching "sig" query parameter.
+	urlSigner *signer.Signer
 )
 
 func main() {
@@ -48,9 +76,67 @@ func main() {
 		panic("BUCKET_NAME environment variable is required")
 	}
 
+	phashCache = phash.NewCache(phashCacheCapacity)
+	phashThreshold = defaultPHashThreshold
+	if v := os.Getenv("PHASH_HAMMING_THRESHOLD"); v != "" {
+		if t, err := strconv.Atoi(v); err == nil {
+			phashThreshold = t
+		} else {
+			log.Printf("DEBUG: Ignoring invalid PHASH_HAMMING_THRESHOLD=%q: %v", v, err)
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if v := os.Getenv("IMG_PROCESSORS"); v != "" {
+		if w, err := strconv.Atoi(v); err == nil && w > 0 {
+			workers = w
+		} else {
+			log.Printf("DEBUG: Ignoring invalid IMG_PROCESSORS=%q: %v", v, err)
+		}
+	}
+	resizePool = imgpool.New(workers, workers*defaultQueueDepthPerWorker)
+
+	activeResizer = resizer.Select(os.Getenv("RESIZER"))
+
+	widths, err := loadAllowedWidths(os.Getenv("ALLOWED_WIDTHS"))
+	if err != nil {
+		panic(fmt.Errorf("invalid ALLOWED_WIDTHS: %w", err))
+	}
+	allowedWidths = widths
+
+	if key := os.Getenv("URL_SIGNING_KEY"); key != "" {
+		urlSigner = signer.New(key)
+	}
+
 	lambda.Start(handler)
 }
 
+// loadAllowedWidths parses a comma-separated ALLOWED_WIDTHS env value into
+// the set of permitted target widths, falling back to defaultAllowedWidths
+// when v is empty.
+func loadAllowedWidths(v string) (map[int]bool, error) {
+	if v == "" {
+		v = defaultAllowedWidths
+	}
+
+	widths := map[int]bool{}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		w, err := strconv.Atoi(s)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid width %q", s)
+		}
+		widths[w] = true
+	}
+	if len(widths) == 0 {
+		return nil, errors.New("must contain at least one width")
+	}
+	return widths, nil
+}
+
 func handler(ctx context.Context, ev events.S3ObjectLambdaEvent) (any, error) {
 	b, err := json.MarshalIndent(ev, "", "  ")
 	if err != nil {
@@ -64,11 +150,17 @@ func handler(ctx context.Context, ev events.S3ObjectLambdaEvent) (any, error) {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
 	}
 
-	targetWidth, err := parseURLToTargetWidth(u)
+	transform, err := parseURLToTransform(u)
 	if err != nil {
+		if errors.Is(err, ErrSignatureMismatch) {
+			if writeErr := writeForbiddenResponse(ctx, ev); writeErr != nil {
+				return nil, writeErr
+			}
+			return nil, nil
+		}
 		return nil, err
 	}
-	log.Printf("DEBUG: Parsed width = %d", targetWidth)
+	log.Printf("DEBUG: Parsed transform = %+v", transform)
 
 	s3Key, err := parseURLToS3Key(u)
 	if err != nil {
@@ -76,50 +168,267 @@ func handler(ctx context.Context, ev events.S3ObjectLambdaEvent) (any, error) {
 	}
 	log.Printf("DEBUG: Parsed S3 key base = %s", s3Key)
 
-	ob, err := fetchOriginalImgFromS3(ctx, bucketName, s3Key)
+	raw, err := fetchOriginalImgFromS3(ctx, bucketName, s3Key)
 	if err != nil {
 		return nil, err
 	}
-	defer ob.Close()
 
-	img, ex, err := decodeImage(ob)
+	cfg, ex, err := decodeImageConfig(raw)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("DEBUG: Decoded image format = %s", ex)
+	log.Printf("DEBUG: Source image format = %s (%dx%d)", ex, cfg.Width, cfg.Height)
 
-	resizedImg, err := resize(img, ex, targetWidth)
+	width, height, err := resolveDimensions(transform, cfg.Width, cfg.Height)
 	if err != nil {
 		return nil, err
 	}
 
-	writeErr := writeGetObjectResponse(ctx, ev, ex, resizedImg)
+	outputFormat := negotiateOutputFormat(ex, ev.UserRequest.Headers["Accept"])
+	log.Printf("DEBUG: Negotiated output format = %s (source %s)", outputFormat, ex)
+
+	hash, img, err := computeSourceHash(raw)
+	if err != nil {
+		return nil, err
+	}
+	variant := variantSignature(width, height, transform.Fit, outputFormat)
+	variantKey := variantObjectKey(hash, width, height, transform.Fit, outputFormat)
+	if cachedKey, hit := lookupVariant(ctx, hash, variant, variantKey); hit {
+		log.Printf("DEBUG: pHash cache hit, serving %s", cachedKey)
+		if served, err := serveCachedVariant(ctx, ev, cachedKey, outputFormat, ex); err == nil && served {
+			return nil, nil
+		} else if err != nil {
+			log.Printf("DEBUG: Failed to serve cached variant %s, falling back to resize: %v", cachedKey, err)
+		}
+	}
+
+	resizedImg, err := submitResize(ctx, ev, raw, img, outputFormat, width, height, transform.Fit)
+	if err != nil || resizedImg == nil {
+		return nil, err
+	}
+
+	phashCache.Put(hash, variant, variantKey)
+	go cacheVariantAsync(bucketName, variantKey, outputFormat, resizedImg.Bytes())
+
+	writeErr := writeGetObjectResponse(ctx, ev, outputFormat, ex, resizedImg)
 	if writeErr != nil {
 		return nil, writeErr
 	}
 	return nil, nil
 }
 
-func parseURLToTargetWidth(u *url.URL) (int, error) {
-	allowedWidths := map[int]bool{240: true, 300: true, 460: true, 700: true, 1040: true}
+// allowedWidths is populated at startup from ALLOWED_WIDTHS (see
+// loadAllowedWidths); it is the set of widths parseURLToTransform accepts.
+var allowedWidths map[int]bool
+
+// ErrSignatureMismatch is returned by parseURLToTransform when URL_SIGNING_KEY
+// is set and the request's "sig" query parameter is missing or incorrect.
+var ErrSignatureMismatch = errors.New("signature mismatch")
+
+// fitModes are the supported Transform.Fit values; "" (unset) preserves the
+// legacy numeric-only behavior of resizing to width while keeping the
+// source aspect ratio.
+var fitModes = map[string]bool{"contain": true, "cover": true, "crop-center": true, "crop-smart": true}
+
+// fitAliases maps additional accepted URL spellings to their canonical
+// fitModes name, so e.g. the shorter "smart" reads naturally in a URL while
+// applyFit only has to handle "crop-smart".
+var fitAliases = map[string]string{"smart": "crop-smart"}
+
+// Transform describes how a source image should be resized. Width is always
+// required; Height, AspectRatio and Fit are populated only by the richer
+// URL forms (e.g. "460x460/cover" or "700/16:9/smart") and are left zero for
+// the legacy numeric-only form ("/photos/cat.jpg/460").
+type Transform struct {
+	Width       int
+	Height      int
+	AspectRatio string
+	Fit         string
+}
+
+// parseURLToTransform parses the trailing path segments of u into a
+// Transform. It accepts four forms:
+//
+//	/<key>/<width>                     legacy, aspect ratio preserved
+//	/<key>/<width>/<fit>               width only, aspect ratio preserved
+//	/<key>/<width>x<height>/<fit>      explicit target dimensions
+//	/<key>/<width>/<ratio>/<fit>       width plus an aspect ratio, e.g. 16:9
+func parseURLToTransform(u *url.URL) (Transform, error) {
+	if urlSigner != nil {
+		if err := verifySignedURL(u); err != nil {
+			return Transform{}, err
+		}
+	}
 
 	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
 
-	widthStr := parts[len(parts)-1]
-	width, err := strconv.Atoi(widthStr)
+	last := parts[len(parts)-1]
+	fit, hasFit := parseFitMode(last)
+	if !hasFit {
+		width, err := strconv.Atoi(last)
+		if err != nil || !allowedWidths[width] {
+			log.Printf("DEBUG: Width parse error or invalid: %v, allowed widths: %v", width, allowedWidths)
+			return Transform{}, allowedWidthsError()
+		}
+		return Transform{Width: width}, nil
+	}
+
+	if len(parts) < 2 {
+		return Transform{}, errors.New("missing size segment before fit mode")
+	}
+
+	// The segment right before the fit mode is either "<width>x<height>" or,
+	// when a third trailing segment is present, an aspect ratio ("16:9")
+	// with the bare width one segment further back: "<width>/<ratio>/<fit>".
+	sizeSeg := parts[len(parts)-2]
+
+	if width, height, ok := parseWxH(sizeSeg); ok {
+		if !allowedWidths[width] {
+			return Transform{}, allowedWidthsError()
+		}
+		return Transform{Width: width, Height: height, Fit: fit}, nil
+	}
+
+	if len(parts) >= 3 {
+		if ratio, ok := parseAspectRatio(sizeSeg); ok {
+			width, err := strconv.Atoi(parts[len(parts)-3])
+			if err != nil || !allowedWidths[width] {
+				return Transform{}, allowedWidthsError()
+			}
+			return Transform{Width: width, AspectRatio: ratio, Fit: fit}, nil
+		}
+	}
+
+	width, err := strconv.Atoi(sizeSeg)
 	if err != nil || !allowedWidths[width] {
-		log.Printf("DEBUG: Width parse error or invalid: %v, allowed widths: %v", width, allowedWidths)
-		return 0, errors.New("width must be one of 240,300,460,700,1040")
+		return Transform{}, allowedWidthsError()
 	}
-	return width, nil
+	return Transform{Width: width, Fit: fit}, nil
+}
+
+// allowedWidthsError reports the current allowedWidths set so the message
+// stays accurate regardless of how ALLOWED_WIDTHS was configured.
+func allowedWidthsError() error {
+	widths := make([]int, 0, len(allowedWidths))
+	for w := range allowedWidths {
+		widths = append(widths, w)
+	}
+	sort.Ints(widths)
+
+	list := make([]string, len(widths))
+	for i, w := range widths {
+		list[i] = strconv.Itoa(w)
+	}
+	return fmt.Errorf("width must be one of %s", strings.Join(list, ","))
+}
+
+// verifySignedURL checks u's "sig" query parameter against the HMAC-SHA256
+// signature urlSigner computes over the path and the rest of the query
+// string, returning ErrSignatureMismatch on any mismatch or absence.
+func verifySignedURL(u *url.URL) error {
+	query := u.Query()
+	sig := query.Get("sig")
+	if sig == "" || !urlSigner.Verify(u.Path, query, sig) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+func parseFitMode(s string) (string, bool) {
+	if canonical, ok := fitAliases[s]; ok {
+		return canonical, true
+	}
+	if fitModes[s] {
+		return s, true
+	}
+	return "", false
+}
+
+func parseWxH(s string) (int, int, bool) {
+	parts := strings.SplitN(s, "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	w, errW := strconv.Atoi(parts[0])
+	h, errH := strconv.Atoi(parts[1])
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+func parseAspectRatio(s string) (string, bool) {
+	_, _, err := aspectRatioParts(s)
+	return s, err == nil
+}
+
+func aspectRatioParts(ratio string) (int, int, error) {
+	parts := strings.SplitN(ratio, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %s", ratio)
+	}
+	w, errW := strconv.Atoi(parts[0])
+	h, errH := strconv.Atoi(parts[1])
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %s", ratio)
+	}
+	return w, h, nil
+}
+
+// resolveDimensions turns a Transform plus the source dimensions into a
+// concrete target width/height.
+func resolveDimensions(t Transform, srcW, srcH int) (int, int, error) {
+	if t.Height > 0 {
+		return t.Width, t.Height, nil
+	}
+
+	if t.AspectRatio != "" {
+		arW, arH, err := aspectRatioParts(t.AspectRatio)
+		if err != nil {
+			return 0, 0, err
+		}
+		height := int(math.Round(float64(t.Width) * float64(arH) / float64(arW)))
+		if height <= 0 {
+			return 0, 0, fmt.Errorf("calculated invalid target height: %d", height)
+		}
+		return t.Width, height, nil
+	}
+
+	height := calculateTargetHeight(srcW, srcH, t.Width)
+	if height <= 0 {
+		return 0, 0, fmt.Errorf("calculated invalid target height: %d", height)
+	}
+	return t.Width, height, nil
+}
+
+// transformSegmentCount mirrors parseURLToTransform's form detection just
+// far enough to know how many trailing path segments belong to the
+// transform, so parseURLToS3Key can strip exactly those.
+func transformSegmentCount(parts []string) int {
+	if len(parts) == 0 {
+		return 0
+	}
+	if _, ok := parseFitMode(parts[len(parts)-1]); ok {
+		if len(parts) >= 3 {
+			if _, ok := parseAspectRatio(parts[len(parts)-2]); ok {
+				return 3
+			}
+		}
+		return 2
+	}
+	return 1
 }
 
 func parseURLToS3Key(u *url.URL) (string, error) {
 	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
-	return strings.Join(parts[:len(parts)-1], "/"), nil
+	n := transformSegmentCount(parts)
+	if n >= len(parts) {
+		return "", errors.New("path must include an object key and a size")
+	}
+	return strings.Join(parts[:len(parts)-n], "/"), nil
 }
 
-func fetchOriginalImgFromS3(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+func fetchOriginalImgFromS3(ctx context.Context, bucket, key string) ([]byte, error) {
 	res, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
@@ -127,6 +436,7 @@ func fetchOriginalImgFromS3(ctx context.Context, bucket, key string) (io.ReadClo
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	if aws.ToInt64(res.ContentLength) > maxBytes {
 		return nil, errors.New("source object too large (>10MB)")
@@ -138,43 +448,76 @@ func fetchOriginalImgFromS3(ctx context.Context, bucket, key string) (io.ReadClo
 		log.Printf("DEBUG: Disallowed content type: %s", ct)
 	}
 
-	return res.Body, nil
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source object: %w", err)
+	}
+	return raw, nil
 }
 
-func decodeImage(ob io.Reader) (image.Image, string, error) {
-	img, format, err := image.Decode(ob)
+// allowedImageFormats are the source formats decodeImage and
+// decodeImageConfig accept; anything else is rejected before any resize work
+// happens.
+var allowedImageFormats = map[string]bool{"jpeg": true, "jpg": true, "png": true}
+
+func decodeImage(raw []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(raw))
 	if err != nil {
 		return nil, "", fmt.Errorf("decode error (jpeg/png only): %v", err)
 	}
-
-	allowedExtensions := map[string]bool{"jpeg": true, "jpg": true, "png": true}
-	if !allowedExtensions[format] {
+	if !allowedImageFormats[format] {
 		return nil, "", fmt.Errorf("unsupported image format: %s", format)
 	}
 	return img, format, nil
 }
 
-func resize(src image.Image, format string, targetWidth int) (*bytes.Buffer, error) {
-	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
-	if targetWidth <= 0 || srcW <= 0 || srcH <= 0 {
-		return nil, fmt.Errorf("invalid image dimensions: srcW=%d, srcH=%d, targetWidth=%d", srcW, srcH, targetWidth)
+// decodeImageConfig reads just the image header to learn its dimensions and
+// format, without decoding pixel data, so handler can size the transform
+// before deciding whether a full decode is actually needed.
+func decodeImageConfig(raw []byte) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("decode error (jpeg/png only): %v", err)
 	}
+	if !allowedImageFormats[format] {
+		return image.Config{}, "", fmt.Errorf("unsupported image format: %s", format)
+	}
+	return cfg, format, nil
+}
 
-	if targetWidth == srcW {
-		return encodeWithConstraints(src, format)
+// computeSourceHash returns a perceptual hash for raw. When the active
+// resizer backend implements resizer.ThumbnailSource, it hashes a
+// shrink-on-load thumbnail instead of requiring a full image.Decode; the
+// returned image.Image is non-nil only when a full decode was actually
+// performed, so callers can reuse it instead of decoding raw a second time.
+func computeSourceHash(raw []byte) (uint64, image.Image, error) {
+	if tr, ok := activeResizer.(resizer.ThumbnailSource); ok {
+		thumb, err := tr.Thumbnail(raw, phash.HashSize)
+		if err == nil {
+			return phash.Compute(thumb), nil, nil
+		}
+		log.Printf("DEBUG: ThumbnailSource failed, falling back to full decode: %v", err)
 	}
 
-	targetHeight := calculateTargetHeight(srcW, srcH, targetWidth)
-	if targetHeight <= 0 {
-		return nil, fmt.Errorf("calculated invalid target height: %d", targetHeight)
+	img, _, err := decodeImage(raw)
+	if err != nil {
+		return 0, nil, err
 	}
+	return phash.Compute(img), img, nil
+}
 
-	resizedImg, err := resizeLanczos(src, targetWidth, targetHeight)
+func resize(src image.Image, format string, width, height int, fit string) (*bytes.Buffer, error) {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if width <= 0 || height <= 0 || srcW <= 0 || srcH <= 0 {
+		return nil, fmt.Errorf("invalid image dimensions: srcW=%d, srcH=%d, targetW=%d, targetH=%d", srcW, srcH, width, height)
+	}
+
+	fitted, err := applyFit(src, width, height, fit)
 	if err != nil {
 		return nil, fmt.Errorf("resize error: %w", err)
 	}
 
-	out, err := encodeWithConstraints(resizedImg, format)
+	out, err := encodeWithConstraints(fitted, format)
 	if err != nil {
 		return nil, fmt.Errorf("encode error: %w", err)
 	}
@@ -182,9 +525,152 @@ func resize(src image.Image, format string, targetWidth int) (*bytes.Buffer, err
 	return out, nil
 }
 
-func resizeLanczos(src image.Image, width, height int) (image.Image, error) {
-	resized := imaging.Resize(src, width, height, imaging.Lanczos)
-	return resized, nil
+// applyFit maps src into a width x height result according to fit, via
+// activeResizer so RESIZER=vips covers every fit mode, not just the legacy
+// width-only resize:
+//   - "" (legacy): resize to width x height, preserving the source aspect
+//     ratio that the caller already baked into height via resolveDimensions.
+//   - "contain": scale the whole image to fit inside the box, keeping its
+//     aspect ratio; no padding is added, so one side may come out smaller.
+//   - "cover": scale to fill the box, cropping any overflow, centered.
+//   - "crop-center": crop a centered width x height window out of the
+//     source, falling back to "cover" if the source is smaller than the box.
+//   - "crop-smart": like crop-center, but the crop window is chosen by
+//     entropy rather than by always being centered.
+func applyFit(src image.Image, width, height int, fit string) (image.Image, error) {
+	if fit == "" {
+		if width == src.Bounds().Dx() {
+			return src, nil
+		}
+		return activeResizer.Resize(src, width, height)
+	}
+	return activeResizer.Fit(src, width, height, fit)
+}
+
+// submitResize hands the resize work off to the shared resizePool and blocks
+// on the result channel with the request context. If the pool's queue is
+// full, it writes a 503 response itself and returns (nil, nil) to signal
+// that the caller is already handled. A non-nil error indicates a genuine
+// failure that the caller should propagate.
+//
+// img is the already-decoded source if the caller had to fully decode raw
+// for some other reason (e.g. phash.Compute on a backend without
+// resizer.ThumbnailSource); it is nil otherwise. When activeResizer
+// implements resizer.RawResizer, the job operates on raw directly and skips
+// Go's image.Decode/encode path entirely. That fast path only covers the
+// legacy width-only resize (fit == "") into a format the RawResizer backend
+// can itself export (jpeg/png): RawResizer.ResizeBytes has no way to express
+// fit modes or the webp/avif encoders, so those requests decode raw (if img
+// isn't already decoded) and go through the decoded-image path instead.
+func submitResize(ctx context.Context, ev events.S3ObjectLambdaEvent, raw []byte, img image.Image, format string, width, height int, fit string) (*bytes.Buffer, error) {
+	start := time.Now()
+
+	resultCh, err := resizePool.Submit(ctx, func() (any, error) {
+		if fit == "" && (format == "jpeg" || format == "jpg" || format == "png") {
+			if rr, ok := activeResizer.(resizer.RawResizer); ok {
+				out, err := rr.ResizeBytes(raw, format, width)
+				if err != nil {
+					return nil, err
+				}
+				return bytes.NewBuffer(out), nil
+			}
+		}
+		if img == nil {
+			decoded, _, err := decodeImage(raw)
+			if err != nil {
+				return nil, err
+			}
+			img = decoded
+		}
+		return resize(img, format, width, height, fit)
+	})
+	if err != nil {
+		if !errors.Is(err, imgpool.ErrQueueFull) {
+			// ctx.Err() (deadline/cancellation) or some other genuine
+			// failure: not a backpressure condition, and writing a response
+			// with this same context would just fail too. Propagate as-is.
+			return nil, err
+		}
+		publishPoolMetricsEMF(resizePool.Depth(), 0, resizePool.RejectCount())
+		if writeErr := writeQueueFullResponse(ctx, ev); writeErr != nil {
+			return nil, writeErr
+		}
+		return nil, nil
+	}
+
+	select {
+	case res := <-resultCh:
+		publishPoolMetricsEMF(resizePool.Depth(), time.Since(start).Milliseconds(), resizePool.RejectCount())
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Value.(*bytes.Buffer), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// writeQueueFullResponse tells the caller to retry shortly. S3 Object
+// Lambda's WriteGetObjectResponse has no field for arbitrary HTTP response
+// headers, so there is no way to emit a real Retry-After header here: the
+// StatusCode 503 is the only signal a generic client sees. ErrorCode and
+// ErrorMessage are genuine WriteGetObjectResponseInput fields — they become
+// the Code/Message of the S3-style error body the caller's SDK parses — so
+// the retry hint rides along there instead.
+func writeQueueFullResponse(ctx context.Context, ev events.S3ObjectLambdaEvent) error {
+	_, err := s3Client.WriteGetObjectResponse(ctx, &s3.WriteGetObjectResponseInput{
+		RequestRoute: aws.String(ev.GetObjectContext.OutputRoute),
+		RequestToken: aws.String(ev.GetObjectContext.OutputToken),
+		StatusCode:   aws.Int32(http.StatusServiceUnavailable),
+		ErrorCode:    aws.String("ResizePoolBusy"),
+		ErrorMessage: aws.String(fmt.Sprintf("resize pool queue is full, retry after %ss", retryAfterSeconds)),
+	})
+	return err
+}
+
+// writeForbiddenResponse rejects a request whose "sig" query parameter did
+// not match, per URL_SIGNING_KEY.
+func writeForbiddenResponse(ctx context.Context, ev events.S3ObjectLambdaEvent) error {
+	_, err := s3Client.WriteGetObjectResponse(ctx, &s3.WriteGetObjectResponseInput{
+		RequestRoute: aws.String(ev.GetObjectContext.OutputRoute),
+		RequestToken: aws.String(ev.GetObjectContext.OutputToken),
+		StatusCode:   aws.Int32(http.StatusForbidden),
+	})
+	return err
+}
+
+// publishPoolMetricsEMF logs a CloudWatch Embedded Metric Format document so
+// resize pool depth, queueing wait time, and reject count show up as
+// CloudWatch metrics without a separate PutMetricData call.
+func publishPoolMetricsEMF(depth int, waitMs int64, rejectCount int64) {
+	doc := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{
+				{
+					"Namespace": "ImgResizer/ResizePool",
+					"Dimensions": [][]string{
+						{},
+					},
+					"Metrics": []map[string]string{
+						{"Name": "PoolDepth", "Unit": "Count"},
+						{"Name": "WaitTimeMs", "Unit": "Milliseconds"},
+						{"Name": "RejectCount", "Unit": "Count"},
+					},
+				},
+			},
+		},
+		"PoolDepth":   depth,
+		"WaitTimeMs":  waitMs,
+		"RejectCount": rejectCount,
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("DEBUG: Failed to marshal pool metrics EMF document: %v", err)
+		return
+	}
+	log.Println(string(b))
 }
 
 func calculateTargetHeight(srcW, srcH, targetW int) int {
@@ -197,6 +683,10 @@ func encodeWithConstraints(img image.Image, format string) (*bytes.Buffer, error
 		return encodeJPEGConstrained(img)
 	case "png":
 		return encodePNGConstrained(img)
+	case "webp":
+		return encodeWebPConstrained(img)
+	case "avif":
+		return encodeAVIFConstrained(img)
 	default:
 		return nil, errors.New("unsupported format: " + format)
 	}
@@ -231,13 +721,228 @@ func encodePNGConstrained(img image.Image) (*bytes.Buffer, error) {
 	return nil, errors.New("cannot satisfy 10MB limit for png")
 }
 
-func writeGetObjectResponse(ctx context.Context, ev events.S3ObjectLambdaEvent, contentType string, body *bytes.Buffer) error {
+func encodeWebPConstrained(img image.Image) (*bytes.Buffer, error) {
+	qualities := []float32{95, 90, 85, 80, 75, 70, 65, 60}
+	for _, q := range qualities {
+		var buf bytes.Buffer
+		opts, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, q)
+		if err != nil {
+			return nil, err
+		}
+		if err := webp.Encode(&buf, img, opts); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= maxBytes {
+			return &buf, nil
+		}
+	}
+	return nil, errors.New("cannot satisfy 10MB limit for webp")
+}
+
+func encodeAVIFConstrained(img image.Image) (*bytes.Buffer, error) {
+	qualities := []int{63, 50, 40} // CRF-style ladder; go-avif treats lower as better, so the lowest quality is tried first
+	for _, q := range qualities {
+		var buf bytes.Buffer
+		if err := avif.Encode(&buf, img, &avif.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= maxBytes {
+			return &buf, nil
+		}
+	}
+	return nil, errors.New("cannot satisfy 10MB limit for avif")
+}
+
+// negotiateOutputFormat picks the best output format the client advertises
+// support for via the Accept header, preferring avif, then webp, then
+// falling back to the source format when neither is accepted with a
+// non-zero q-value.
+func negotiateOutputFormat(srcFormat, accept string) string {
+	entries := parseAccept(accept)
+	if acceptsFormat(entries, "image/avif") {
+		return "avif"
+	}
+	if acceptsFormat(entries, "image/webp") {
+		return "webp"
+	}
+	return srcFormat
+}
+
+type acceptEntry struct {
+	mime string
+	q    float64
+}
+
+// parseAccept does a minimal parse of an HTTP Accept header into media
+// types and their q-values, defaulting to q=1 when unspecified.
+func parseAccept(accept string) []acceptEntry {
+	var entries []acceptEntry
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		segs := strings.Split(part, ";")
+		entry := acceptEntry{mime: strings.TrimSpace(segs[0]), q: 1}
+		for _, seg := range segs[1:] {
+			seg = strings.TrimSpace(seg)
+			if v, ok := strings.CutPrefix(seg, "q="); ok {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					entry.q = q
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func acceptsFormat(entries []acceptEntry, mime string) bool {
+	wildcard := false
+	for _, e := range entries {
+		if e.mime == mime {
+			return e.q > 0
+		}
+		if e.mime == "*/*" && e.q > 0 {
+			wildcard = true
+		}
+	}
+	return wildcard
+}
+
+// contentTypeForFormat maps an internal format name to the Content-Type
+// written in the response.
+func contentTypeForFormat(format string) string {
+	switch format {
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	case "avif":
+		return "image/avif"
+	default:
+		return format
+	}
+}
+
+// variantFileExtension maps an internal format name to the file extension
+// used in cached variant S3 keys.
+func variantFileExtension(format string) string {
+	switch format {
+	case "jpeg":
+		return "jpg"
+	default:
+		return format
+	}
+}
+
+// variantSignature identifies a transform (width, height, fit and format)
+// independent of any particular source hash, so the in-process near-duplicate
+// cache can be scoped to "same transform" rather than just "same hash
+// neighborhood". The legacy width-only shape is kept for fit == "" so it
+// lines up with variantObjectKey's legacy key shape.
+func variantSignature(width, height int, fit, format string) string {
+	ext := variantFileExtension(format)
+	if fit == "" {
+		return fmt.Sprintf("%d.%s", width, ext)
+	}
+	return fmt.Sprintf("%dx%d-%s.%s", width, height, fit, ext)
+}
+
+// variantObjectKey returns the S3 key under which a resized variant of the
+// source image identified by hash is cached for the given transform.
+func variantObjectKey(hash uint64, width, height int, fit, format string) string {
+	return fmt.Sprintf("phash/%016x/%s", hash, variantSignature(width, height, fit, format))
+}
+
+// lookupVariant returns the S3 key of an already-rendered variant matching
+// exactKey, if one is known. It first checks for an exact match in S3, then
+// falls back to the container-local LRU of recent near-duplicate hashes,
+// restricted to hashes previously seen for the same variant.
+func lookupVariant(ctx context.Context, hash uint64, variant, exactKey string) (string, bool) {
+	if headObjectExists(ctx, exactKey) {
+		return exactKey, true
+	}
+	return phashCache.Lookup(hash, variant, phashThreshold)
+}
+
+func headObjectExists(ctx context.Context, key string) bool {
+	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return err == nil
+}
+
+// serveCachedVariant streams the already-rendered variant at key straight
+// through to the caller, bypassing decode/resize/encode entirely.
+func serveCachedVariant(ctx context.Context, ev events.S3ObjectLambdaEvent, key, format, srcFormat string) (bool, error) {
+	res, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	_, err = s3Client.WriteGetObjectResponse(ctx, &s3.WriteGetObjectResponseInput{
+		RequestRoute:  aws.String(ev.GetObjectContext.OutputRoute),
+		RequestToken:  aws.String(ev.GetObjectContext.OutputToken),
+		StatusCode:    aws.Int32(http.StatusOK),
+		ContentType:   aws.String(contentTypeForFormat(format)),
+		CacheControl:  aws.String(cacheControlFor(format, srcFormat)),
+		ContentLength: res.ContentLength,
+		Body:          res.Body,
+	})
+	return err == nil, err
+}
+
+// cacheVariantAsync persists a freshly-resized variant under its pHash key so
+// future requests for visually-identical sources can skip the resize. The
+// in-process LRU used for near-duplicate lookups is updated by handler, not
+// here.
+func cacheVariantAsync(bucket, key, format string, data []byte) {
+	_, err := s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentTypeForFormat(format)),
+	})
+	if err != nil {
+		log.Printf("DEBUG: Failed to cache resized variant %s: %v", key, err)
+	}
+}
+
+// cacheControlFor returns the Cache-Control directive for a response whose
+// content negotiation outcome was format, given the object's actual
+// srcFormat. S3 Object Lambda's WriteGetObjectResponse has no field for an
+// arbitrary HTTP response header, so this code cannot emit a real
+// "Vary: Accept" — any shared cache sitting in front of this access point
+// (CDN, browser) that keys purely on URL has no way to know a response
+// depends on the caller's Accept header. A format picked by negotiation
+// (avif/webp) is therefore only safe to serve from this Lambda directly, not
+// from a shared cache that might replay it to a client that never claimed to
+// accept it; the unnegotiated, source-format response has no such dependency
+// and keeps the long immutable cache lifetime.
+func cacheControlFor(format, srcFormat string) string {
+	if format == srcFormat {
+		return cacheControlImmutable
+	}
+	return "private, no-store"
+}
+
+// writeGetObjectResponse writes the final response.
+func writeGetObjectResponse(ctx context.Context, ev events.S3ObjectLambdaEvent, format, srcFormat string, body *bytes.Buffer) error {
 	input := &s3.WriteGetObjectResponseInput{
 		RequestRoute:  aws.String(ev.GetObjectContext.OutputRoute),
 		RequestToken:  aws.String(ev.GetObjectContext.OutputToken),
 		StatusCode:    aws.Int32(http.StatusOK),
-		ContentType:   aws.String(contentType),
-		CacheControl:  aws.String(cacheControlImmutable),
+		ContentType:   aws.String(contentTypeForFormat(format)),
+		CacheControl:  aws.String(cacheControlFor(format, srcFormat)),
 		ContentLength: aws.Int64(int64(body.Len())),
 		Body:          body,
 	}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	widths, err := loadAllowedWidths("")
+	if err != nil {
+		panic(err)
+	}
+	allowedWidths = widths
+	m.Run()
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", raw, err)
+	}
+	return u
+}
+
+func TestParseURLToTransformLegacyWidthOnly(t *testing.T) {
+	got, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/460"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Transform{Width: 460}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseURLToTransformWidthByHeightAndFit(t *testing.T) {
+	got, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/460x460/cover"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Transform{Width: 460, Height: 460, Fit: "cover"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseURLToTransformWidthRatioAndFit(t *testing.T) {
+	got, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/700/16:9/crop-smart"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Transform{Width: 700, AspectRatio: "16:9", Fit: "crop-smart"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseURLToTransformSmartAlias(t *testing.T) {
+	got, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/700/16:9/smart"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Transform{Width: 700, AspectRatio: "16:9", Fit: "crop-smart"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseURLToTransformWidthAndFitNoRatio(t *testing.T) {
+	got, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/700/cover"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Transform{Width: 700, Fit: "cover"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseURLToTransformRejectsDisallowedWidth(t *testing.T) {
+	if _, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/123")); err == nil {
+		t.Fatal("expected an error for a width outside allowedWidths")
+	}
+}
+
+func TestParseURLToTransformRejectsDisallowedWidthWithRatio(t *testing.T) {
+	if _, err := parseURLToTransform(mustParseURL(t, "/photos/cat.jpg/123/16:9/smart")); err == nil {
+		t.Fatal("expected an error for a width outside allowedWidths in the ratio form")
+	}
+}
+
+func TestParseURLToS3KeyStripsExactlyTheTransformSegments(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/photos/cat.jpg/460", "photos/cat.jpg"},
+		{"/photos/cat.jpg/460x460/cover", "photos/cat.jpg"},
+		{"/photos/cat.jpg/700/16:9/crop-smart", "photos/cat.jpg"},
+		{"/photos/cat.jpg/700/16:9/smart", "photos/cat.jpg"},
+		{"/photos/cat.jpg/700/cover", "photos/cat.jpg"},
+	}
+	for _, tc := range tests {
+		got, err := parseURLToS3Key(mustParseURL(t, tc.path))
+		if err != nil {
+			t.Errorf("parseURLToS3Key(%q): unexpected error: %v", tc.path, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseURLToS3Key(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package phash computes perceptual hashes for images so that visually
+// identical source objects can be recognized even when they live under
+// different S3 keys.
+package phash
+
+import (
+	"image"
+	"math"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	HashSize = 32 // source is downsized to HashSize x HashSize before the DCT
+	blockDim = 8  // top-left blockDim x blockDim DCT coefficients are kept
+)
+
+// Compute downsizes img to a 32x32 grayscale luminance matrix, runs a 2D DCT
+// over it, and derives a 64-bit hash from the top-left 8x8 block of
+// coefficients (excluding the DC term). Bit i is 1 iff coefficient i is
+// above the mean of the 63 AC coefficients considered.
+func Compute(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, HashSize, HashSize, imaging.Lanczos))
+
+	matrix := make([][]float64, HashSize)
+	for y := 0; y < HashSize; y++ {
+		matrix[y] = make([]float64, HashSize)
+		for x := 0; x < HashSize; x++ {
+			r, _, _, _ := small.At(x, y).RGBA()
+			matrix[y][x] = float64(r >> 8)
+		}
+	}
+
+	dct := dct2D(matrix)
+
+	var sum float64
+	coeffs := make([]float64, 0, blockDim*blockDim-1)
+	for y := 0; y < blockDim; y++ {
+		for x := 0; x < blockDim; x++ {
+			if x == 0 && y == 0 {
+				continue // DC term
+			}
+			v := dct[y][x]
+			coeffs = append(coeffs, v)
+			sum += v
+		}
+	}
+	mean := sum / float64(len(coeffs))
+
+	var hash uint64
+	for i, v := range coeffs {
+		if v > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// dct2D runs a naive separable 2D discrete cosine transform over an NxN
+// matrix (1D DCT-II over rows, then over the resulting columns). HashSize is
+// small enough (32x32) that the O(N^3) approach is fine for a per-request
+// Lambda invocation.
+func dct2D(matrix [][]float64) [][]float64 {
+	n := len(matrix)
+
+	rows := make([][]float64, n)
+	for y := 0; y < n; y++ {
+		rows[y] = dct1D(matrix[y])
+	}
+
+	out := make([][]float64, n)
+	for y := range out {
+		out[y] = make([]float64, n)
+	}
+	for x := 0; x < n; x++ {
+		col := make([]float64, n)
+		for y := 0; y < n; y++ {
+			col[y] = rows[y][x]
+		}
+		col = dct1D(col)
+		for y := 0; y < n; y++ {
+			out[y][x] = col[y]
+		}
+	}
+	return out
+}
+
+func dct1D(in []float64) []float64 {
+	n := len(in)
+	out := make([]float64, n)
+	for k := 0; k < n; k++ {
+		var sum float64
+		for i, v := range in {
+			sum += v * math.Cos(math.Pi/float64(n)*(float64(i)+0.5)*float64(k))
+		}
+		c := 1.0
+		if k == 0 {
+			c = 1.0 / math.Sqrt2
+		}
+		out[k] = sum * c * math.Sqrt(2.0/float64(n))
+	}
+	return out
+}
+
+// HammingDistance returns the number of differing bits between two hashes.
+func HammingDistance(a, b uint64) int {
+	x := a ^ b
+	count := 0
+	for x != 0 {
+		count++
+		x &= x - 1
+	}
+	return count
+}
+
+// entry is a single recently-seen hash, scoped to one variant (width,
+// height, fit and format), mapped to the S3 key it resolved to.
+type entry struct {
+	hash    uint64
+	variant string
+	key     string
+}
+
+// Cache is a small in-memory, least-recently-used cache of recent source
+// image hashes, scoped to a single Lambda container. It lets near-duplicate
+// lookups skip a resize when a visually similar source was already served.
+type Cache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  []entry // most-recently-used at the end
+}
+
+// NewCache returns a Cache holding at most capacity entries.
+func NewCache(capacity int) *Cache {
+	return &Cache{capacity: capacity}
+}
+
+// Lookup returns the S3 key of the most recent cached hash within threshold
+// Hamming distance of hash, restricted to entries recorded under the same
+// variant (the target width/height/fit/format), if any. A near-duplicate
+// source hashed under a different variant is not a usable match here, even
+// if its hash is close.
+func (c *Cache) Lookup(hash uint64, variant string, threshold int) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		if c.entries[i].variant == variant && HammingDistance(c.entries[i].hash, hash) <= threshold {
+			// Move the hit to the most-recently-used end.
+			e := c.entries[i]
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			c.entries = append(c.entries, e)
+			return e.key, true
+		}
+	}
+	return "", false
+}
+
+// Put records hash as resolving to key for the given variant, evicting the
+// least-recently-used entry if the cache is at capacity.
+func (c *Cache) Put(hash uint64, variant, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = append(c.entries, entry{hash: hash, variant: variant, key: key})
+	if len(c.entries) > c.capacity {
+		c.entries = c.entries[len(c.entries)-c.capacity:]
+	}
+}
@@ -0,0 +1,78 @@
+package phash
+
+import "testing"
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0b1010, 0b0101, 4},
+		{^uint64(0), 0, 64},
+	}
+	for _, tc := range tests {
+		if got := HammingDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("HammingDistance(%b, %b) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestCacheLookupWithinThreshold(t *testing.T) {
+	c := NewCache(8)
+	c.Put(0b0000, "thumb", "phash/0000/thumb.jpg")
+
+	key, hit := c.Lookup(0b0001, "thumb", 1)
+	if !hit || key != "phash/0000/thumb.jpg" {
+		t.Fatalf("Lookup(0b0001, threshold=1) = (%q, %v), want a hit on the stored key", key, hit)
+	}
+}
+
+func TestCacheLookupBeyondThreshold(t *testing.T) {
+	c := NewCache(8)
+	c.Put(0b0000, "thumb", "phash/0000/thumb.jpg")
+
+	if _, hit := c.Lookup(0b1111, "thumb", 1); hit {
+		t.Fatalf("Lookup matched a hash outside the Hamming threshold")
+	}
+}
+
+func TestCacheLookupScopedToVariant(t *testing.T) {
+	c := NewCache(8)
+	c.Put(0b0000, "240.jpg", "phash/0000/240.jpg")
+
+	if _, hit := c.Lookup(0b0000, "1040.jpg", 4); hit {
+		t.Fatalf("Lookup returned a match cached under a different variant")
+	}
+	if _, hit := c.Lookup(0b0000, "240.jpg", 4); !hit {
+		t.Fatalf("Lookup missed a match cached under the same variant")
+	}
+}
+
+func TestCacheEvictsOldestAtCapacity(t *testing.T) {
+	c := NewCache(2)
+	c.Put(0b0000, "v", "first")
+	c.Put(0b0001, "v", "second")
+	c.Put(0b0010, "v", "third")
+
+	if _, hit := c.Lookup(0b0000, "v", 0); hit {
+		t.Fatalf("Lookup found an entry that should have been evicted")
+	}
+	if key, hit := c.Lookup(0b0001, "v", 0); !hit || key != "second" {
+		t.Fatalf("Lookup(0b0001) = (%q, %v), want a hit on \"second\"", key, hit)
+	}
+	if key, hit := c.Lookup(0b0010, "v", 0); !hit || key != "third" {
+		t.Fatalf("Lookup(0b0010) = (%q, %v), want a hit on \"third\"", key, hit)
+	}
+}
+
+func TestCacheLookupPrefersMostRecent(t *testing.T) {
+	c := NewCache(8)
+	c.Put(0b0000, "v", "older")
+	c.Put(0b0000, "v", "newer")
+
+	if key, hit := c.Lookup(0b0000, "v", 0); !hit || key != "newer" {
+		t.Fatalf("Lookup = (%q, %v), want the most recently put entry", key, hit)
+	}
+}
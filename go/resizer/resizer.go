@@ -0,0 +1,86 @@
+// Package resizer abstracts the image resampling backend so the Lambda can
+// switch between the pure-Go imaging/Lanczos path and a libvips-backed path
+// for large sources without touching the handler.
+package resizer
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+
+	"github.com/katsuokaisao/img-resizer/go/smartcrop"
+)
+
+// Resizer resamples a decoded image to the given dimensions.
+type Resizer interface {
+	// Resize performs the legacy width-only resize, preserving the source
+	// aspect ratio the caller already baked into h.
+	Resize(src image.Image, w, h int) (image.Image, error)
+
+	// Fit resamples src into a w x h box according to fit ("contain",
+	// "cover", "crop-center" or "crop-smart"), so a pluggable backend (e.g.
+	// libvips) can cover these modes too instead of only the legacy resize.
+	// "contain" returns an image that fits within the box, so one side may
+	// be smaller than requested.
+	Fit(src image.Image, w, h int, fit string) (image.Image, error)
+}
+
+// RawResizer is an optional extension a Resizer backend can implement to
+// operate directly on the source's encoded bytes, bypassing Go's
+// image.Decode entirely (e.g. libvips' streaming shrink-on-load). It returns
+// the already re-encoded output bytes for the given target width.
+type RawResizer interface {
+	ResizeBytes(in []byte, format string, w int) ([]byte, error)
+}
+
+// ThumbnailSource is an optional extension a Resizer backend can implement to
+// produce a small preview image.Image directly from encoded bytes via
+// shrink-on-load, for callers (namely phash hashing) that only need a
+// low-resolution copy and would otherwise force a full-size image.Decode.
+type ThumbnailSource interface {
+	Thumbnail(in []byte, size int) (image.Image, error)
+}
+
+// Lanczos is the default, pure-Go Resizer backed by imaging.Lanczos.
+type Lanczos struct{}
+
+// Resize implements Resizer.
+func (Lanczos) Resize(src image.Image, w, h int) (image.Image, error) {
+	return imaging.Resize(src, w, h, imaging.Lanczos), nil
+}
+
+// Fit implements Resizer.
+func (Lanczos) Fit(src image.Image, w, h int, fit string) (image.Image, error) {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+
+	switch fit {
+	case "contain":
+		return imaging.Fit(src, w, h, imaging.Lanczos), nil
+	case "cover":
+		return imaging.Fill(src, w, h, imaging.Center, imaging.Lanczos), nil
+	case "crop-center":
+		if srcW < w || srcH < h {
+			return imaging.Fill(src, w, h, imaging.Center, imaging.Lanczos), nil
+		}
+		return imaging.CropAnchor(src, w, h, imaging.Center), nil
+	case "crop-smart":
+		rect := smartcrop.BestCropRect(src, w, h)
+		return imaging.Resize(imaging.Crop(src, rect), w, h, imaging.Lanczos), nil
+	default:
+		return nil, fmt.Errorf("unsupported fit mode: %s", fit)
+	}
+}
+
+// Select returns the Resizer named by the RESIZER env var. Unknown values,
+// an empty value, or a backend unavailable in this build (see the novips
+// build tag) all fall back to Lanczos.
+func Select(name string) Resizer {
+	switch name {
+	case "vips":
+		if r := newVipsResizer(); r != nil {
+			return r
+		}
+	}
+	return Lanczos{}
+}
@@ -0,0 +1,10 @@
+//go:build novips
+
+package resizer
+
+// newVipsResizer is stubbed out under the novips build tag so the pure-Go
+// build has no cgo/libvips dependency. RESIZER=vips silently falls back to
+// Lanczos in this build.
+func newVipsResizer() Resizer {
+	return nil
+}
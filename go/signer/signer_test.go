@@ -0,0 +1,75 @@
+package signer
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	s := New("shared-secret")
+	params := url.Values{"w": {"460"}, "fit": {"cover"}}
+
+	sig := s.Sign("/photos/cat.jpg/460x460/cover", params)
+	if !s.Verify("/photos/cat.jpg/460x460/cover", params, sig) {
+		t.Fatalf("Verify rejected a signature Sign just produced")
+	}
+}
+
+func TestVerifyRejectsWrongSignature(t *testing.T) {
+	s := New("shared-secret")
+	params := url.Values{"w": {"460"}}
+
+	if s.Verify("/photos/cat.jpg/460", params, "deadbeef") {
+		t.Fatalf("Verify accepted an incorrect signature")
+	}
+}
+
+func TestVerifyRejectsWrongKey(t *testing.T) {
+	params := url.Values{"w": {"460"}}
+	sig := New("key-a").Sign("/photos/cat.jpg/460", params)
+
+	if New("key-b").Verify("/photos/cat.jpg/460", params, sig) {
+		t.Fatalf("Verify accepted a signature produced with a different key")
+	}
+}
+
+func TestVerifyRejectsTamperedPath(t *testing.T) {
+	s := New("shared-secret")
+	params := url.Values{"w": {"460"}}
+	sig := s.Sign("/photos/cat.jpg/460", params)
+
+	if s.Verify("/photos/dog.jpg/460", params, sig) {
+		t.Fatalf("Verify accepted a signature for a different path")
+	}
+}
+
+func TestVerifyRejectsTamperedParams(t *testing.T) {
+	s := New("shared-secret")
+	sig := s.Sign("/photos/cat.jpg/460", url.Values{"w": {"460"}})
+
+	if s.Verify("/photos/cat.jpg/460", url.Values{"w": {"700"}}, sig) {
+		t.Fatalf("Verify accepted a signature for different params")
+	}
+}
+
+func TestSignIgnoresExistingSigParam(t *testing.T) {
+	s := New("shared-secret")
+	params := url.Values{"w": {"460"}}
+
+	withoutSig := s.Sign("/photos/cat.jpg/460", params)
+
+	withSig := url.Values{"w": {"460"}, "sig": {"stale"}}
+	if got := s.Sign("/photos/cat.jpg/460", withSig); got != withoutSig {
+		t.Fatalf("Sign was affected by a pre-existing sig param: got %q, want %q", got, withoutSig)
+	}
+}
+
+func TestSignIsOrderIndependent(t *testing.T) {
+	s := New("shared-secret")
+
+	a := s.Sign("/photos/cat.jpg/460", url.Values{"w": {"460"}, "fit": {"cover"}})
+	b := s.Sign("/photos/cat.jpg/460", url.Values{"fit": {"cover"}, "w": {"460"}})
+	if a != b {
+		t.Fatalf("Sign depended on query parameter order: %q != %q", a, b)
+	}
+}
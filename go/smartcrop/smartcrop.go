@@ -0,0 +1,152 @@
+// Package smartcrop picks a crop window for an image by favoring the region
+// with the most visual detail, measured as Shannon entropy of the grayscale
+// histogram, rather than always cropping around the geometric center.
+package smartcrop
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultGrid is the number of tiles per axis used to score the image when
+// no grid size is given.
+const DefaultGrid = 8
+
+// BestCropRect returns the highest-entropy crop window of src matching the
+// aspectW:aspectH ratio, found by scoring an 8x8 grid of tiles and sliding
+// the largest same-ratio window over their entropy integral image.
+func BestCropRect(src image.Image, aspectW, aspectH int) image.Rectangle {
+	return BestCropRectGrid(src, aspectW, aspectH, DefaultGrid)
+}
+
+// BestCropRectGrid is BestCropRect with an explicit grid size, exposed for
+// tests.
+func BestCropRectGrid(src image.Image, aspectW, aspectH, gridN int) image.Rectangle {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if gridN < 1 {
+		gridN = DefaultGrid
+	}
+	if aspectW <= 0 || aspectH <= 0 {
+		aspectW, aspectH = srcW, srcH
+	}
+
+	tileW := maxInt(srcW/gridN, 1)
+	tileH := maxInt(srcH/gridN, 1)
+
+	gray := imaging.Grayscale(src)
+	entropy := make([][]float64, gridN)
+	for gy := 0; gy < gridN; gy++ {
+		entropy[gy] = make([]float64, gridN)
+		y0, y1 := gy*tileH, (gy+1)*tileH
+		if gy == gridN-1 {
+			y1 = srcH
+		}
+		for gx := 0; gx < gridN; gx++ {
+			x0, x1 := gx*tileW, (gx+1)*tileW
+			if gx == gridN-1 {
+				x1 = srcW
+			}
+			entropy[gy][gx] = tileEntropy(gray, x0, y0, x1, y1)
+		}
+	}
+	integral := buildIntegral(entropy, gridN)
+
+	// Tiles are not square unless the source is, so express the target
+	// ratio in grid cells before choosing the window size.
+	winW, winH := bestWindowSize(gridN, aspectW*tileH, aspectH*tileW)
+
+	bestSum := -1.0
+	bestGX, bestGY := 0, 0
+	for gy := 0; gy+winH <= gridN; gy++ {
+		for gx := 0; gx+winW <= gridN; gx++ {
+			if sum := windowSum(integral, gx, gy, winW, winH); sum > bestSum {
+				bestSum = sum
+				bestGX, bestGY = gx, gy
+			}
+		}
+	}
+
+	x0, y0 := bestGX*tileW, bestGY*tileH
+	x1, y1 := (bestGX+winW)*tileW, (bestGY+winH)*tileH
+	if bestGX+winW == gridN {
+		x1 = srcW
+	}
+	if bestGY+winH == gridN {
+		y1 = srcH
+	}
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// tileEntropy computes the Shannon entropy of the grayscale histogram of the
+// [x0,x1)x[y0,y1) region of gray.
+func tileEntropy(gray image.Image, x0, y0, x1, y1 int) float64 {
+	var hist [256]int
+	total := 0
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			r, _, _, _ := gray.At(x, y).RGBA()
+			hist[r>>8]++
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var entropy float64
+	for _, count := range hist {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// buildIntegral returns the summed-area table of e, sized (n+1)x(n+1) so
+// windowSum can read rectangle sums in O(1).
+func buildIntegral(e [][]float64, n int) [][]float64 {
+	integral := make([][]float64, n+1)
+	for i := range integral {
+		integral[i] = make([]float64, n+1)
+	}
+	for y := 1; y <= n; y++ {
+		for x := 1; x <= n; x++ {
+			integral[y][x] = e[y-1][x-1] + integral[y-1][x] + integral[y][x-1] - integral[y-1][x-1]
+		}
+	}
+	return integral
+}
+
+func windowSum(integral [][]float64, gx, gy, w, h int) float64 {
+	x0, y0, x1, y1 := gx, gy, gx+w, gy+h
+	return integral[y1][x1] - integral[y0][x1] - integral[y1][x0] + integral[y0][x0]
+}
+
+// bestWindowSize returns the largest grid-cell window of size (w,h), with
+// w,h in [1,gridN], whose ratio most closely matches aspectW:aspectH.
+func bestWindowSize(gridN, aspectW, aspectH int) (int, int) {
+	bestW, bestH, bestArea := 1, 1, 0
+	for h := 1; h <= gridN; h++ {
+		w := int(math.Round(float64(h) * float64(aspectW) / float64(aspectH)))
+		if w < 1 || w > gridN {
+			continue
+		}
+		if area := w * h; area > bestArea {
+			bestArea = area
+			bestW, bestH = w, h
+		}
+	}
+	return bestW, bestH
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}